@@ -0,0 +1,76 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Astro is a specification for an Astro resource.
+type Astro struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AstroSpec   `json:"spec"`
+	Status AstroStatus `json:"status,omitempty"`
+}
+
+// AstroSpec is the spec for an Astro resource.
+type AstroSpec struct {
+	DeploymentName string `json:"deploymentName"`
+	ServiceName    string `json:"serviceName"`
+	Replicas       *int32 `json:"replicas"`
+	Image          string `json:"image"`
+	Port           int32  `json:"port"`
+
+	// PreserveResourcesOnDeletion, when true, leaves the owned Deployment and
+	// Service in-cluster after the Astro is deleted instead of letting them be
+	// garbage collected, so a replacement controller can adopt them.
+	// +optional
+	PreserveResourcesOnDeletion *bool `json:"preserveResourcesOnDeletion,omitempty"`
+}
+
+// Phase values reported on AstroStatus.Phase.
+const (
+	AstroPhasePending     = "Pending"
+	AstroPhaseProgressing = "Progressing"
+	AstroPhaseAvailable   = "Available"
+	AstroPhaseDegraded    = "Degraded"
+)
+
+// ConditionTypeReady is the Condition type reporting the aggregate
+// readiness of an Astro's owned Deployment.
+const ConditionTypeReady = "Ready"
+
+// AstroStatus is the status for an Astro resource.
+type AstroStatus struct {
+	AvailableReplicas int32 `json:"availableReplicas"`
+
+	// Phase is a high level summary of where the Astro is in its lifecycle:
+	// Pending, Progressing, Available or Degraded.
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// ObservedGeneration is the most recent generation observed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the Astro's state.
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// AstroList is a list of Astro resources.
+type AstroList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []Astro `json:"items"`
+}
@@ -2,19 +2,32 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/kasterism/astertower/pkg/apis/v1alpha1"
 	astertowerclientset "github.com/kasterism/astertower/pkg/clients/clientset/astertower"
 	informers "github.com/kasterism/astertower/pkg/clients/informer/externalversions/apis/v1alpha1"
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	appsinformers "k8s.io/client-go/informers/apps/v1"
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -24,6 +37,20 @@ import (
 const (
 	// name of finalizer
 	AstroFinalizer = "astros.astertower.kasterism.io"
+
+	// controllerAgentName is the component reported on events emitted by this controller.
+	controllerAgentName = "astro-controller"
+
+	// Event reasons emitted by the controller.
+	reasonSuccessfulCreate   = "SuccessfulCreate"
+	reasonSuccessfulDelete   = "SuccessfulDelete"
+	reasonFailedSync         = "FailedSync"
+	reasonErrResourceExists  = "ErrResourceExists"
+	reasonResourcesPreserved = "ResourcesPreserved"
+
+	// messageResourceExists is the message used for Events when a resource
+	// fails to sync due to a pre-existing, non-owned resource of the same name.
+	messageResourceExists = "Resource %q already exists and is not managed by Astro"
 )
 
 type AstroController struct {
@@ -33,25 +60,52 @@ type AstroController struct {
 
 	deploymentInformer appsinformers.DeploymentInformer
 
+	deploymentLister appslisters.DeploymentLister
+
 	serviceInformer coreinformers.ServiceInformer
 
+	serviceLister corelisters.ServiceLister
+
 	astroInformer informers.AstroInformer
 
-	workqueue workqueue.RateLimitingInterface
+	workqueue workqueue.TypedRateLimitingInterface[cache.ObjectName]
 
 	recorder record.EventRecorder
 }
 
+// newRateLimiter builds the rate limiter used by the Astro workqueue: an
+// exponential per-item backoff composed with an overall 50 QPS / 300 burst
+// bucket limiter. The backoff matches the client-go default controller rate
+// limiter; the bucket is larger than its 10 QPS / 100 burst.
+func newRateLimiter() workqueue.TypedRateLimiter[cache.ObjectName] {
+	return workqueue.NewTypedMaxOfRateLimiter(
+		workqueue.NewTypedItemExponentialFailureRateLimiter[cache.ObjectName](5*time.Millisecond, 1000*time.Second),
+		&workqueue.TypedBucketRateLimiter[cache.ObjectName]{Limiter: rate.NewLimiter(rate.Limit(50), 300)},
+	)
+}
+
 func NewAstroController(kubeClientset kubernetes.Interface, astroClientset astertowerclientset.Interface,
 	deploymentInformer appsinformers.DeploymentInformer, serviceInformer coreinformers.ServiceInformer,
 	astroInformer informers.AstroInformer) *AstroController {
+	utilruntime.Must(v1alpha1.AddToScheme(scheme.Scheme))
+
+	klog.V(4).Infoln("Creating event broadcaster")
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClientset.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
+
 	astroController := &AstroController{
 		kubeClientset:      kubeClientset,
 		astroClientset:     astroClientset,
 		deploymentInformer: deploymentInformer,
+		deploymentLister:   deploymentInformer.Lister(),
 		serviceInformer:    serviceInformer,
+		serviceLister:      serviceInformer.Lister(),
 		astroInformer:      astroInformer,
-		workqueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "astro"),
+		workqueue: workqueue.NewTypedRateLimitingQueueWithConfig(newRateLimiter(),
+			workqueue.TypedRateLimitingQueueConfig[cache.ObjectName]{Name: "astro"}),
+		recorder: recorder,
 	}
 
 	klog.Infoln("Setting up Astro event handlers")
@@ -65,177 +119,568 @@ func NewAstroController(kubeClientset kubernetes.Interface, astroClientset aster
 		klog.Fatalln("Failed to add event handlers")
 	}
 
+	_, err = deploymentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: astroController.handleObject,
+		UpdateFunc: func(old, new interface{}) {
+			newDeployment := new.(*appsv1.Deployment)
+			oldDeployment := old.(*appsv1.Deployment)
+			if newDeployment.ResourceVersion == oldDeployment.ResourceVersion {
+				return
+			}
+			astroController.handleObject(new)
+		},
+		DeleteFunc: astroController.handleObject,
+	})
+	if err != nil {
+		klog.Fatalln("Failed to add deployment event handlers")
+	}
+
+	_, err = serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: astroController.handleObject,
+		UpdateFunc: func(old, new interface{}) {
+			newService := new.(*corev1.Service)
+			oldService := old.(*corev1.Service)
+			if newService.ResourceVersion == oldService.ResourceVersion {
+				return
+			}
+			astroController.handleObject(new)
+		},
+		DeleteFunc: astroController.handleObject,
+	})
+	if err != nil {
+		klog.Fatalln("Failed to add service event handlers")
+	}
+
 	return astroController
 }
 
-func (c *AstroController) Run(thread int, stopCh <-chan struct{}) error {
-	defer runtime.HandleCrash()
+func (c *AstroController) Run(ctx context.Context, thread int) error {
+	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShuttingDown()
 
-	klog.Infoln("Starting Astro control loop")
+	logger := klog.FromContext(ctx)
+	logger.Info("Starting Astro control loop")
 
-	klog.Infoln("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.astroInformer.Informer().HasSynced); !ok {
+	logger.Info("Waiting for informer caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.astroInformer.Informer().HasSynced,
+		c.deploymentInformer.Informer().HasSynced, c.serviceInformer.Informer().HasSynced); !ok {
 		return fmt.Errorf("failed to wati for caches to sync")
 	}
 
-	klog.Infoln("Starting workers")
+	logger.Info("Starting workers")
 	for i := 0; i < thread; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
 	}
 
-	klog.Infoln("Started workers")
-	<-stopCh
-	klog.Infoln("Shutting down workers")
+	logger.Info("Started workers")
+	<-ctx.Done()
+	logger.Info("Shutting down workers")
 	return nil
 }
 
-func (c *AstroController) runWorker() {
-	for c.processNextWorkItem() {
+func (c *AstroController) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
 	}
 }
 
-func (c *AstroController) processNextWorkItem() bool {
-	item, shutdown := c.workqueue.Get()
+func (c *AstroController) processNextWorkItem(ctx context.Context) bool {
+	objectName, shutdown := c.workqueue.Get()
 	if shutdown {
 		return false
 	}
 
-	if err := func(item interface{}) error {
-		defer c.workqueue.Done(item)
-		var (
-			key string
-			ok  bool
-		)
-		if key, ok = item.(string); !ok {
-			c.workqueue.Forget(item)
-			runtime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", item))
-			return nil
-		}
-		if err := c.syncHandler(key); err != nil {
-			return fmt.Errorf("error syncing '%s':%s", item, err.Error())
+	if err := func(objectName cache.ObjectName) error {
+		defer c.workqueue.Done(objectName)
+
+		if err := c.syncHandler(ctx, objectName); err != nil {
+			c.workqueue.AddRateLimited(objectName)
+			return fmt.Errorf("error syncing '%s': %s, requeuing", objectName, err.Error())
 		}
-		c.workqueue.Forget(item)
+		c.workqueue.Forget(objectName)
 		return nil
-	}(item); err != nil {
-		runtime.HandleError(err)
-		return false
+	}(objectName); err != nil {
+		utilruntime.HandleErrorWithContext(ctx, err, "Error processing item")
+		return true
 	}
 	return true
 }
 
-func (c *AstroController) syncHandler(key string) error {
-	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+// handleObject looks up the owning Astro of a child Deployment/Service and
+// enqueues it for reconciliation. Objects without an Astro controller owner
+// are ignored.
+func (c *AstroController) handleObject(obj interface{}) {
+	object, ok := obj.(v1.Object)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
+			return
+		}
+		object, ok = tombstone.Obj.(v1.Object)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
+			return
+		}
+	}
+
+	owner := v1.GetControllerOf(object)
+	if owner == nil {
+		return
+	}
+	if owner.Kind != "Astro" {
+		return
+	}
+
+	astro, err := c.astroInformer.Lister().Astros(object.GetNamespace()).Get(owner.Name)
 	if err != nil {
-		runtime.HandleError(fmt.Errorf("invalid respirce key:%s", key))
+		klog.Infof("Ignoring orphaned object '%s/%s' of astro '%s'", object.GetNamespace(), object.GetName(), owner.Name)
+		return
 	}
 
-	astro, err := c.astroInformer.Lister().Astros(namespace).Get(name)
+	c.workqueue.AddRateLimited(cache.MetaObjectToName(astro))
+}
+
+func (c *AstroController) syncHandler(ctx context.Context, objectName cache.ObjectName) error {
+	logger := klog.FromContext(ctx).WithValues("astro", objectName)
+	ctx = klog.NewContext(ctx, logger)
+
+	astro, err := c.astroInformer.Lister().Astros(objectName.Namespace).Get(objectName.Name)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			return nil
 		}
-		runtime.HandleError(fmt.Errorf("failed to get astro by: %s/%s", namespace, name))
+		utilruntime.HandleErrorWithContext(ctx, err, "Failed to get astro", "astro", objectName)
 		return err
 	}
 	if !astro.DeletionTimestamp.IsZero() {
-		return c.syncDelete(astro)
-	}
-
-	for _, finalizer := range astro.Finalizers {
-		if finalizer == AstroFinalizer {
-			return c.syncUpdate(astro)
+		err = c.syncDelete(ctx, astro)
+	} else {
+		hasFinalizer := false
+		for _, finalizer := range astro.Finalizers {
+			if finalizer == AstroFinalizer {
+				hasFinalizer = true
+				break
+			}
+		}
+		if hasFinalizer {
+			err = c.syncUpdate(ctx, astro)
+		} else {
+			err = c.syncCreate(ctx, astro)
 		}
 	}
 
-	// TODO: do something
-	return c.syncCreate(astro)
+	if err != nil {
+		c.recorder.Event(astro, corev1.EventTypeWarning, reasonFailedSync, err.Error())
+	}
+	return err
 }
 
 func (c *AstroController) addAstro(item interface{}) {
-	var key string
-	var err error
-	if key, err = cache.MetaNamespaceKeyFunc(item); err != nil {
-		runtime.HandleError(err)
-		return
-	}
+	astro := item.(*v1alpha1.Astro)
 
 	klog.Infoln("Enqueue the astro crd for adding")
 
-	c.workqueue.AddRateLimited(key)
+	c.workqueue.AddRateLimited(cache.MetaObjectToName(astro))
 }
 
 func (c *AstroController) deleteAstro(item interface{}) {
-	var key string
-	var err error
-	if key, err = cache.DeletionHandlingMetaNamespaceKeyFunc(item); err != nil {
-		runtime.HandleError(err)
+	objectName, err := cache.DeletionHandlingObjectToName(item)
+	if err != nil {
+		utilruntime.HandleError(err)
 		return
 	}
 
 	klog.Infoln("Enqueue the astro crd for deleting")
 
-	c.workqueue.AddRateLimited(key)
+	c.workqueue.AddRateLimited(objectName)
 }
 
 func (c *AstroController) updateAstro(old, new interface{}) {
-	var key string
-	var err error
-
 	oldItem := old.(*v1alpha1.Astro)
 	newItem := new.(*v1alpha1.Astro)
 	if oldItem.ResourceVersion == newItem.ResourceVersion {
 		return
 	}
 
-	if key, err = cache.MetaNamespaceKeyFunc(new); err != nil {
-		runtime.HandleError(err)
-		return
-	}
-
 	klog.Infoln("Enqueue the astro crd for updating")
 
-	c.workqueue.AddRateLimited(key)
+	c.workqueue.AddRateLimited(cache.MetaObjectToName(newItem))
 }
 
-func (c *AstroController) syncCreate(astro *v1alpha1.Astro) error {
-	klog.Infof("Sync create astro: %s\n", astro.Name)
+// newDeployment returns the Deployment owned by astro, built from its spec.
+func newDeployment(astro *v1alpha1.Astro) *appsv1.Deployment {
+	labels := map[string]string{
+		"app":   "astro",
+		"astro": astro.Name,
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            astro.Spec.DeploymentName,
+			Namespace:       astro.Namespace,
+			OwnerReferences: []v1.OwnerReference{*v1.NewControllerRef(astro, v1alpha1.SchemeGroupVersion.WithKind("Astro"))},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: astro.Spec.Replicas,
+			Selector: &v1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "astro",
+							Image: astro.Spec.Image,
+							Ports: []corev1.ContainerPort{
+								{
+									ContainerPort: astro.Spec.Port,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// newService returns the Service owned by astro, fronting its Deployment.
+func newService(astro *v1alpha1.Astro) *corev1.Service {
+	labels := map[string]string{
+		"app":   "astro",
+		"astro": astro.Name,
+	}
+	return &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            astro.Spec.ServiceName,
+			Namespace:       astro.Namespace,
+			OwnerReferences: []v1.OwnerReference{*v1.NewControllerRef(astro, v1alpha1.SchemeGroupVersion.WithKind("Astro"))},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{
+					Port:       astro.Spec.Port,
+					TargetPort: intstr.FromInt32(astro.Spec.Port),
+				},
+			},
+		},
+	}
+}
+
+// reconcileDeployment ensures the Deployment owned by astro matches its spec,
+// creating it if absent, and returns the resulting Deployment.
+func (c *AstroController) reconcileDeployment(ctx context.Context, astro *v1alpha1.Astro) (*appsv1.Deployment, error) {
+	deployment, err := c.deploymentLister.Deployments(astro.Namespace).Get(astro.Spec.DeploymentName)
+	if errors.IsNotFound(err) {
+		created, err := c.kubeClientset.AppsV1().Deployments(astro.Namespace).Create(ctx,
+			newDeployment(astro), v1.CreateOptions{})
+		if err == nil {
+			c.recorder.Eventf(astro, corev1.EventTypeNormal, reasonSuccessfulCreate, "Created deployment %q", created.Name)
+		}
+		return created, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !v1.IsControlledBy(deployment, astro) {
+		c.recorder.Eventf(astro, corev1.EventTypeWarning, reasonErrResourceExists, messageResourceExists, deployment.Name)
+		return nil, fmt.Errorf("resource %s/%s already exists and is not managed by astro %s",
+			deployment.Namespace, deployment.Name, astro.Name)
+	}
+
+	if astro.Spec.Replicas != nil && *astro.Spec.Replicas != *deployment.Spec.Replicas ||
+		deployment.Spec.Template.Spec.Containers[0].Image != astro.Spec.Image ||
+		deployment.Spec.Template.Spec.Containers[0].Ports[0].ContainerPort != astro.Spec.Port {
+		desired := deployment.DeepCopy()
+		desired.Spec.Replicas = astro.Spec.Replicas
+		desired.Spec.Template.Spec.Containers[0].Image = astro.Spec.Image
+		desired.Spec.Template.Spec.Containers[0].Ports[0].ContainerPort = astro.Spec.Port
+		deployment, err = c.kubeClientset.AppsV1().Deployments(astro.Namespace).Update(ctx, desired, v1.UpdateOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// Add finalizer when creating resources
-	astro.Finalizers = append(astro.Finalizers, AstroFinalizer)
+	return deployment, nil
+}
 
-	_, err := c.astroClientset.AstertowerV1alpha1().Astros(astro.Namespace).Update(context.TODO(),
-		astro, v1.UpdateOptions{})
+// reconcileService ensures the Service owned by astro matches its spec,
+// creating it if absent.
+func (c *AstroController) reconcileService(ctx context.Context, astro *v1alpha1.Astro) error {
+	service, err := c.serviceLister.Services(astro.Namespace).Get(astro.Spec.ServiceName)
+	if errors.IsNotFound(err) {
+		created, err := c.kubeClientset.CoreV1().Services(astro.Namespace).Create(ctx,
+			newService(astro), v1.CreateOptions{})
+		if err == nil {
+			c.recorder.Eventf(astro, corev1.EventTypeNormal, reasonSuccessfulCreate, "Created service %q", created.Name)
+		}
+		return err
+	}
 	if err != nil {
-		runtime.HandleError(err)
 		return err
 	}
+
+	if !v1.IsControlledBy(service, astro) {
+		c.recorder.Eventf(astro, corev1.EventTypeWarning, reasonErrResourceExists, messageResourceExists, service.Name)
+		return fmt.Errorf("resource %s/%s already exists and is not managed by astro %s",
+			service.Namespace, service.Name, astro.Name)
+	}
+
+	if len(service.Spec.Ports) == 0 || service.Spec.Ports[0].Port != astro.Spec.Port {
+		desired := service.DeepCopy()
+		desired.Spec.Ports = newService(astro).Spec.Ports
+		_, err = c.kubeClientset.CoreV1().Services(astro.Namespace).Update(ctx, desired, v1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (c *AstroController) syncUpdate(astro *v1alpha1.Astro) error {
-	klog.Infof("Sync update astro: %s\n", astro.Name)
+func (c *AstroController) syncCreate(ctx context.Context, astro *v1alpha1.Astro) error {
+	klog.FromContext(ctx).Info("Sync create astro", "astro", astro.Name)
 
-	return nil
+	deployment, err := c.reconcileDeployment(ctx, astro)
+	if err != nil {
+		return err
+	}
+	if err := c.reconcileService(ctx, astro); err != nil {
+		return err
+	}
+
+	astro, err = c.patchFinalizer(ctx, astro, true)
+	if err != nil {
+		return err
+	}
+
+	return c.updateAstroStatus(ctx, astro, deployment)
 }
 
-func (c *AstroController) syncDelete(astro *v1alpha1.Astro) error {
-	klog.Infof("Sync delete astro: %s\n", astro.Name)
+// patchFinalizer adds or removes AstroFinalizer on astro via a merge patch
+// scoped to metadata.finalizers, so it cannot conflict with concurrent
+// spec/status updates. astro is never mutated, since it may be the lister's
+// shared cache object: the patch is built from a fresh slice. It is
+// idempotent: if the finalizer is already in the desired state, no request
+// is made.
+func (c *AstroController) patchFinalizer(ctx context.Context, astro *v1alpha1.Astro, present bool) (*v1alpha1.Astro, error) {
+	patch, changed, err := finalizerMergePatch(astro.Finalizers, present)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return astro, nil
+	}
+
+	return c.astroClientset.AstertowerV1alpha1().Astros(astro.Namespace).
+		Patch(ctx, astro.Name, types.MergePatchType, patch, v1.PatchOptions{})
+}
 
-	// Remove finalizer when deleting resources
-	for i, finalizer := range astro.Finalizers {
+// finalizerMergePatch returns the merge patch body that sets AstroFinalizer's
+// presence in finalizers to present, along with whether a patch is needed at
+// all. It never mutates finalizers.
+func finalizerMergePatch(finalizers []string, present bool) ([]byte, bool, error) {
+	has := false
+	for _, finalizer := range finalizers {
 		if finalizer == AstroFinalizer {
-			astro.Finalizers[i] = astro.Finalizers[len(astro.Finalizers)-1]
-			astro.Finalizers = astro.Finalizers[:len(astro.Finalizers)-1]
+			has = true
+			break
+		}
+	}
+	if has == present {
+		return nil, false, nil
+	}
+
+	var desired []string
+	if present {
+		desired = append(append([]string{}, finalizers...), AstroFinalizer)
+	} else {
+		desired = make([]string, 0, len(finalizers))
+		for _, finalizer := range finalizers {
+			if finalizer != AstroFinalizer {
+				desired = append(desired, finalizer)
+			}
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers": desired,
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return patch, true, nil
+}
+
+func (c *AstroController) syncUpdate(ctx context.Context, astro *v1alpha1.Astro) error {
+	klog.FromContext(ctx).Info("Sync update astro", "astro", astro.Name)
+
+	deployment, err := c.reconcileDeployment(ctx, astro)
+	if err != nil {
+		return err
+	}
+	if err := c.reconcileService(ctx, astro); err != nil {
+		return err
+	}
+
+	return c.updateAstroStatus(ctx, astro, deployment)
+}
+
+// updateAstroStatus computes the aggregate Ready condition and Phase for
+// astro from the state of its owned Deployment and persists the status
+// subresource if it changed.
+func (c *AstroController) updateAstroStatus(ctx context.Context, astro *v1alpha1.Astro, deployment *appsv1.Deployment) error {
+	newStatus := computeAstroStatus(astro, deployment)
+
+	if apiequality.Semantic.DeepEqual(astro.Status, *newStatus) {
+		return nil
+	}
+
+	updated := astro.DeepCopy()
+	updated.Status = *newStatus
+	_, err := c.astroClientset.AstertowerV1alpha1().Astros(astro.Namespace).UpdateStatus(ctx, updated, v1.UpdateOptions{})
+	return err
+}
+
+// computeAstroStatus derives the status astro should report from the
+// current state of its owned deployment: AvailableReplicas, Phase, and the
+// aggregate Ready condition.
+func computeAstroStatus(astro *v1alpha1.Astro, deployment *appsv1.Deployment) *v1alpha1.AstroStatus {
+	desiredReplicas := int32(1)
+	if astro.Spec.Replicas != nil {
+		desiredReplicas = *astro.Spec.Replicas
+	}
+
+	newStatus := astro.Status.DeepCopy()
+	newStatus.AvailableReplicas = deployment.Status.AvailableReplicas
+	newStatus.ObservedGeneration = astro.Generation
+
+	condition := v1.Condition{
+		Type:   v1alpha1.ConditionTypeReady,
+		Status: v1.ConditionFalse,
+	}
+
+	switch {
+	case deploymentHasReplicaFailure(deployment):
+		newStatus.Phase = v1alpha1.AstroPhaseDegraded
+		condition.Reason = "ReplicaFailure"
+		condition.Message = fmt.Sprintf("Deployment %q has a ReplicaFailure condition", deployment.Name)
+	case deployment.Status.ObservedGeneration == 0:
+		newStatus.Phase = v1alpha1.AstroPhasePending
+		condition.Reason = "DeploymentNotObserved"
+		condition.Message = fmt.Sprintf("Deployment %q has not yet been observed by its controller", deployment.Name)
+	case deployment.Status.AvailableReplicas >= desiredReplicas:
+		newStatus.Phase = v1alpha1.AstroPhaseAvailable
+		condition.Status = v1.ConditionTrue
+		condition.Reason = "DeploymentAvailable"
+		condition.Message = fmt.Sprintf("Deployment %q has %d/%d replicas available", deployment.Name, deployment.Status.AvailableReplicas, desiredReplicas)
+	default:
+		newStatus.Phase = v1alpha1.AstroPhaseProgressing
+		condition.Reason = "DeploymentProgressing"
+		condition.Message = fmt.Sprintf("Deployment %q has %d/%d replicas available", deployment.Name, deployment.Status.AvailableReplicas, desiredReplicas)
+	}
+
+	meta.SetStatusCondition(&newStatus.Conditions, condition)
+	return newStatus
+}
+
+// deploymentHasReplicaFailure reports whether deployment's conditions
+// include a ReplicaFailure condition in status True.
+func deploymentHasReplicaFailure(deployment *appsv1.Deployment) bool {
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue {
+			return true
 		}
 	}
+	return false
+}
+
+func (c *AstroController) syncDelete(ctx context.Context, astro *v1alpha1.Astro) error {
+	klog.FromContext(ctx).Info("Sync delete astro", "astro", astro.Name)
 
-	_, err := c.astroClientset.AstertowerV1alpha1().Astros(astro.Namespace).Update(context.TODO(),
-		astro, v1.UpdateOptions{})
+	preserve := astro.Spec.PreserveResourcesOnDeletion != nil && *astro.Spec.PreserveResourcesOnDeletion
+	if preserve {
+		if err := c.preserveOwnedResources(ctx, astro); err != nil {
+			return err
+		}
+	}
+
+	astro, err := c.patchFinalizer(ctx, astro, false)
 	if err != nil {
-		runtime.HandleError(err)
 		return err
 	}
 
+	if !preserve {
+		c.recorder.Eventf(astro, corev1.EventTypeNormal, reasonSuccessfulDelete,
+			"Deleted astro %q, owned deployment %q and service %q will be garbage collected",
+			astro.Name, astro.Spec.DeploymentName, astro.Spec.ServiceName)
+	}
+
+	return nil
+}
+
+// preserveOwnedResources strips astro's ownerReference from its owned
+// Deployment and Service via a JSON patch so they survive the Astro's
+// deletion instead of being garbage collected.
+func (c *AstroController) preserveOwnedResources(ctx context.Context, astro *v1alpha1.Astro) error {
+	var preserved []string
+
+	deployment, err := c.deploymentLister.Deployments(astro.Namespace).Get(astro.Spec.DeploymentName)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if patch, ok := removeOwnerReferencePatch(deployment.OwnerReferences, astro.UID); ok {
+			if _, err := c.kubeClientset.AppsV1().Deployments(astro.Namespace).
+				Patch(ctx, deployment.Name, types.JSONPatchType, patch, v1.PatchOptions{}); err != nil {
+				return err
+			}
+			preserved = append(preserved, fmt.Sprintf("deployment/%s", deployment.Name))
+		}
+	}
+
+	service, err := c.serviceLister.Services(astro.Namespace).Get(astro.Spec.ServiceName)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if patch, ok := removeOwnerReferencePatch(service.OwnerReferences, astro.UID); ok {
+			if _, err := c.kubeClientset.CoreV1().Services(astro.Namespace).
+				Patch(ctx, service.Name, types.JSONPatchType, patch, v1.PatchOptions{}); err != nil {
+				return err
+			}
+			preserved = append(preserved, fmt.Sprintf("service/%s", service.Name))
+		}
+	}
+
+	if len(preserved) > 0 {
+		c.recorder.Eventf(astro, corev1.EventTypeNormal, reasonResourcesPreserved,
+			"Retained %s after astro %q deletion", strings.Join(preserved, ", "), astro.Name)
+	}
+
 	return nil
 }
+
+// removeOwnerReferencePatch returns a JSON patch removing the ownerReference
+// entry matching ownerUID from ownerRefs, or false if it is not present. The
+// patch leads with a "test" op asserting the UID is still at that index, so
+// if the owner reference array has changed server-side since ownerRefs was
+// read (e.g. from the lister cache), the patch fails instead of silently
+// removing the wrong entry.
+func removeOwnerReferencePatch(ownerRefs []v1.OwnerReference, ownerUID types.UID) ([]byte, bool) {
+	for i, ref := range ownerRefs {
+		if ref.UID == ownerUID {
+			path := fmt.Sprintf("/metadata/ownerReferences/%d", i)
+			return []byte(fmt.Sprintf(
+				`[{"op":"test","path":%q,"value":%q},{"op":"remove","path":%q}]`,
+				path+"/uid", ownerUID, path)), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/kasterism/astertower/pkg/apis/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFinalizerMergePatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		finalizers  []string
+		present     bool
+		wantChanged bool
+		wantPatch   map[string]interface{}
+	}{
+		{
+			name:        "add when absent",
+			finalizers:  nil,
+			present:     true,
+			wantChanged: true,
+			wantPatch: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"finalizers": []interface{}{AstroFinalizer},
+				},
+			},
+		},
+		{
+			name:        "add when already present is a no-op",
+			finalizers:  []string{AstroFinalizer},
+			present:     true,
+			wantChanged: false,
+		},
+		{
+			name:        "remove when present",
+			finalizers:  []string{"other.finalizer", AstroFinalizer},
+			present:     false,
+			wantChanged: true,
+			wantPatch: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"finalizers": []interface{}{"other.finalizer"},
+				},
+			},
+		},
+		{
+			name:        "remove when already absent is a no-op",
+			finalizers:  []string{"other.finalizer"},
+			present:     false,
+			wantChanged: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := append([]string(nil), tt.finalizers...)
+
+			patch, changed, err := finalizerMergePatch(tt.finalizers, tt.present)
+			if err != nil {
+				t.Fatalf("finalizerMergePatch() error = %v", err)
+			}
+			if changed != tt.wantChanged {
+				t.Fatalf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+
+			for i := range tt.finalizers {
+				if tt.finalizers[i] != original[i] {
+					t.Fatalf("finalizerMergePatch mutated its input slice: got %v, want %v", tt.finalizers, original)
+				}
+			}
+
+			if !tt.wantChanged {
+				if patch != nil {
+					t.Fatalf("patch = %s, want nil", patch)
+				}
+				return
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(patch, &got); err != nil {
+				t.Fatalf("json.Unmarshal(patch) error = %v", err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.wantPatch)
+			if string(gotJSON) != string(wantJSON) {
+				t.Fatalf("patch = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestRemoveOwnerReferencePatch(t *testing.T) {
+	ownerUID := types.UID("owner-uid")
+
+	t.Run("uid not found", func(t *testing.T) {
+		refs := []v1.OwnerReference{{UID: "other-uid"}}
+		if _, ok := removeOwnerReferencePatch(refs, ownerUID); ok {
+			t.Fatalf("removeOwnerReferencePatch() ok = true, want false")
+		}
+	})
+
+	t.Run("uid found emits a test-then-remove patch at its index", func(t *testing.T) {
+		refs := []v1.OwnerReference{{UID: "other-uid"}, {UID: ownerUID}}
+
+		patch, ok := removeOwnerReferencePatch(refs, ownerUID)
+		if !ok {
+			t.Fatalf("removeOwnerReferencePatch() ok = false, want true")
+		}
+
+		var ops []map[string]string
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			t.Fatalf("json.Unmarshal(patch) error = %v", err)
+		}
+		if len(ops) != 2 {
+			t.Fatalf("len(ops) = %d, want 2", len(ops))
+		}
+		if ops[0]["op"] != "test" || ops[0]["path"] != "/metadata/ownerReferences/1/uid" || ops[0]["value"] != string(ownerUID) {
+			t.Fatalf("ops[0] = %v, want test op asserting the uid at index 1", ops[0])
+		}
+		if ops[1]["op"] != "remove" || ops[1]["path"] != "/metadata/ownerReferences/1" {
+			t.Fatalf("ops[1] = %v, want remove op at index 1", ops[1])
+		}
+	})
+}
+
+func TestComputeAstroStatus(t *testing.T) {
+	replicas := int32(2)
+
+	newAstro := func() *v1alpha1.Astro {
+		return &v1alpha1.Astro{
+			Spec: v1alpha1.AstroSpec{Replicas: &replicas},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		wantPhase  string
+		wantReady  v1.ConditionStatus
+	}{
+		{
+			name:       "not yet observed is pending",
+			deployment: &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "d"}},
+			wantPhase:  v1alpha1.AstroPhasePending,
+			wantReady:  v1.ConditionFalse,
+		},
+		{
+			name: "replica failure is degraded",
+			deployment: &appsv1.Deployment{
+				ObjectMeta: v1.ObjectMeta{Name: "d"},
+				Status: appsv1.DeploymentStatus{
+					ObservedGeneration: 1,
+					Conditions: []appsv1.DeploymentCondition{
+						{Type: appsv1.DeploymentReplicaFailure, Status: corev1.ConditionTrue},
+					},
+				},
+			},
+			wantPhase: v1alpha1.AstroPhaseDegraded,
+			wantReady: v1.ConditionFalse,
+		},
+		{
+			name: "observed but not enough replicas is progressing",
+			deployment: &appsv1.Deployment{
+				ObjectMeta: v1.ObjectMeta{Name: "d"},
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, AvailableReplicas: 1},
+			},
+			wantPhase: v1alpha1.AstroPhaseProgressing,
+			wantReady: v1.ConditionFalse,
+		},
+		{
+			name: "enough replicas available is available",
+			deployment: &appsv1.Deployment{
+				ObjectMeta: v1.ObjectMeta{Name: "d"},
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, AvailableReplicas: 2},
+			},
+			wantPhase: v1alpha1.AstroPhaseAvailable,
+			wantReady: v1.ConditionTrue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := computeAstroStatus(newAstro(), tt.deployment)
+
+			if status.Phase != tt.wantPhase {
+				t.Fatalf("Phase = %q, want %q", status.Phase, tt.wantPhase)
+			}
+			cond := meta.FindStatusCondition(status.Conditions, v1alpha1.ConditionTypeReady)
+			if cond == nil {
+				t.Fatalf("missing Ready condition")
+			}
+			if cond.Status != tt.wantReady {
+				t.Fatalf("Ready condition status = %q, want %q", cond.Status, tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestReconcileDeploymentCreateDoesNotAlsoUpdate(t *testing.T) {
+	replicas := int32(1)
+	astro := &v1alpha1.Astro{
+		ObjectMeta: v1.ObjectMeta{Name: "my-astro", Namespace: "default", UID: "astro-uid"},
+		Spec: v1alpha1.AstroSpec{
+			DeploymentName: "my-deployment",
+			Image:          "example/image:v1",
+			Replicas:       &replicas,
+			Port:           8080,
+		},
+	}
+
+	kubeClientset := kubefake.NewSimpleClientset()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	c := &AstroController{
+		kubeClientset:    kubeClientset,
+		deploymentLister: appslisters.NewDeploymentLister(indexer),
+		recorder:         record.NewFakeRecorder(10),
+	}
+
+	deployment, err := c.reconcileDeployment(context.Background(), astro)
+	if err != nil {
+		t.Fatalf("reconcileDeployment() error = %v", err)
+	}
+	if deployment.Name != astro.Spec.DeploymentName {
+		t.Fatalf("deployment.Name = %q, want %q", deployment.Name, astro.Spec.DeploymentName)
+	}
+
+	actions := kubeClientset.Actions()
+	if len(actions) != 1 {
+		t.Fatalf("actions = %v, want exactly one create action", actions)
+	}
+	if actions[0].GetVerb() != "create" {
+		t.Fatalf("actions[0].GetVerb() = %q, want %q", actions[0].GetVerb(), "create")
+	}
+}
+
+func TestReconcileDeploymentUpdatesOnPortDrift(t *testing.T) {
+	replicas := int32(1)
+	astro := &v1alpha1.Astro{
+		ObjectMeta: v1.ObjectMeta{Name: "my-astro", Namespace: "default", UID: "astro-uid"},
+		Spec: v1alpha1.AstroSpec{
+			DeploymentName: "my-deployment",
+			Image:          "example/image:v1",
+			Replicas:       &replicas,
+			Port:           9090,
+		},
+	}
+
+	existing := newDeployment(astro)
+	existing.Spec.Template.Spec.Containers[0].Ports[0].ContainerPort = 8080
+
+	kubeClientset := kubefake.NewSimpleClientset(existing)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(existing); err != nil {
+		t.Fatalf("indexer.Add() error = %v", err)
+	}
+	c := &AstroController{
+		kubeClientset:    kubeClientset,
+		deploymentLister: appslisters.NewDeploymentLister(indexer),
+		recorder:         record.NewFakeRecorder(10),
+	}
+
+	deployment, err := c.reconcileDeployment(context.Background(), astro)
+	if err != nil {
+		t.Fatalf("reconcileDeployment() error = %v", err)
+	}
+	if got := deployment.Spec.Template.Spec.Containers[0].Ports[0].ContainerPort; got != astro.Spec.Port {
+		t.Fatalf("ContainerPort = %d, want %d", got, astro.Spec.Port)
+	}
+}